@@ -0,0 +1,82 @@
+// Copyright 2011 The llgo Authors.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package cabi rewrites a compiled module's IR so that it conforms
+// to the calling convention of its target triple's underlying C ABI:
+// aggregate arguments are split or coerced into register-sized
+// pieces, large returns go through a hidden sret pointer, and (for
+// PNaCl) the IR is additionally restricted to the stable subset
+// pnacl-abicheck accepts. irgen runs this pass once per module, after
+// all of a package's functions have been generated with their
+// "natural" Go signatures, so every backend (x86, arm, pnacl) shares
+// one lowering path parameterized by triple rather than each call
+// site special-casing its target.
+package cabi
+
+import (
+	"strings"
+
+	"github.com/axw/gollvm/llvm"
+	"github.com/axw/llgo/driver"
+)
+
+// Lowering holds the state needed to lower a module's functions to
+// the ABI of a particular target.
+type Lowering struct {
+	target llvm.TargetData
+
+	// abi is the small-aggregate-passing convention to classify
+	// parameters and returns for, selected from the target triple's
+	// architecture field.
+	abi abi
+
+	// pnacl is true when the module's triple is PNaCl's, in which
+	// case Lower additionally restricts emitted IR to the subset
+	// pnacl-abicheck accepts (see restrict.go).
+	pnacl bool
+}
+
+// New creates a Lowering for the given target's data layout and
+// triple. triple and pnacl should be the same TargetTriple and flag
+// driver.ResolveTarget used to resolve the target machine, so that
+// the ABI this chooses to classify aggregates for matches the
+// backend module will actually be code-generated for.
+func New(target llvm.TargetData, triple string, pnacl bool) *Lowering {
+	arch := triple[:strings.IndexRune(triple, '-')]
+	return &Lowering{target: target, abi: abiFor(driver.ParseArch(arch)), pnacl: pnacl}
+}
+
+// Lower rewrites module so that every function's externally-visible
+// symbol matches the target's C ABI, and (for PNaCl) so the module's
+// IR stays within pnacl-abicheck's stable subset. It must run after
+// all of a module's functions have been generated, and before the
+// module is handed to the backend for codegen.
+//
+// Lowering a function's signature does not touch its body or its
+// callers: lowerSignature renames the natural-Go-ABI definition aside
+// and generates a same-named wrapper with the C-conformant signature
+// that unpacks its arguments and tail-calls through. Existing call
+// instructions within the module still reference the renamed
+// original llvm.Value directly, so intra-package Go-to-Go calls pay
+// no coercion overhead; only callers outside this module, which can
+// only ever see the symbol name, go through the wrapper.
+func (l *Lowering) Lower(module llvm.Module) error {
+	for fn := module.FirstFunction(); fn.C != nil; fn = llvm.NextFunction(fn) {
+		if fn.IsDeclaration() {
+			continue
+		}
+		if err := l.lowerSignature(fn); err != nil {
+			return err
+		}
+		if err := l.checkLandingPads(fn); err != nil {
+			return err
+		}
+	}
+	if l.pnacl {
+		return l.restrict(module)
+	}
+	return nil
+}
+
+// vim: set ft=go :
@@ -0,0 +1,121 @@
+// Copyright 2011 The llgo Authors.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package cabi
+
+import "github.com/axw/gollvm/llvm"
+
+// class is how classify says a value should be passed or returned.
+type class int
+
+const (
+	// classDirect values are passed in registers, as themselves (for
+	// scalars) or coerced to an equivalent sequence of integers (for
+	// small aggregates).
+	classDirect class = iota
+
+	// classMemory values are passed via a pointer: an incoming
+	// parameter is replaced by a pointer the callee loads through,
+	// and a return value is replaced by a hidden first parameter
+	// (sret) the callee stores through.
+	classMemory
+)
+
+// maxDirectSize is the largest aggregate, in bytes, abiSysV and
+// abiAAPCS will pass by value in registers rather than through a
+// pointer. Chosen to match the common two-eightbyte case of the
+// System V x86-64 ABI and its analogue on AAPCS.
+const maxDirectSize = 16
+
+// abi is one of the small-aggregate-passing conventions this package
+// knows how to classify for, selected by the target triple's
+// architecture (see abiFor).
+type abi int
+
+const (
+	// abiSysV is the System V x86-64 ABI: aggregates up to
+	// maxDirectSize are coerced into a sequence of 8-byte
+	// "eightbyte" registers; larger ones go through memory.
+	abiSysV abi = iota
+
+	// abiAAPCS is the ARM Procedure Call Standard: aggregates up to
+	// maxDirectSize are coerced the same way as abiSysV, but into
+	// 4-byte words rather than 8-byte ones.
+	abiAAPCS
+
+	// abiCDecl386 is i386 cdecl: aggregates of any size are always
+	// passed through memory (on the stack), never coerced into
+	// registers.
+	abiCDecl386
+)
+
+// abiFor returns the calling convention to classify aggregates for,
+// given a driver.ParseArch-normalized architecture name. Unrecognized
+// architectures get abiCDecl386, the most conservative of the three:
+// it never coerces an aggregate into registers, so misclassifying a
+// register-based target as abiCDecl386 produces a function that's
+// always safe to call through memory, merely more conservative than
+// it needed to be.
+func abiFor(arch string) abi {
+	switch arch {
+	case "x86-64":
+		return abiSysV
+	case "arm", "thumb":
+		return abiAAPCS
+	default:
+		return abiCDecl386
+	}
+}
+
+// wordSize returns the eightbyte/word size a's register coercion
+// packs aggregates into.
+func (a abi) wordSize() uint64 {
+	if a == abiAAPCS {
+		return 4
+	}
+	return 8
+}
+
+// classify returns how a value of type t should be classified when
+// passed as an argument or returned, per a's calling convention and
+// target's data layout. Non-aggregate types are always classDirect:
+// the backend's own calling convention lowering already gets scalars
+// right, and it's only aggregates that LLVM and the platform ABI can
+// disagree about.
+func classify(a abi, target llvm.TargetData, t llvm.Type) class {
+	switch t.TypeKind() {
+	case llvm.StructTypeKind, llvm.ArrayTypeKind:
+		if a == abiCDecl386 {
+			return classMemory
+		}
+		if target.TypeAllocSize(t) > maxDirectSize {
+			return classMemory
+		}
+		return classDirect
+	default:
+		return classDirect
+	}
+}
+
+// coerce returns the LLVM type a classDirect aggregate of the given
+// byte size is packed into for argument/return passing under a: a
+// sequence of a.wordSize()-byte integer registers, save for a final
+// smaller integer when size isn't a multiple of the word size. This
+// matches what a C compiler's classifier would hand the backend for
+// a small struct passed in integer registers.
+func coerce(a abi, size uint64) llvm.Type {
+	word := a.wordSize()
+	n := size / word
+	var fields []llvm.Type
+	wordType := llvm.IntType(int(word * 8))
+	for i := uint64(0); i < n; i++ {
+		fields = append(fields, wordType)
+	}
+	if rem := size % word; rem != 0 {
+		fields = append(fields, llvm.IntType(int(rem*8)))
+	}
+	return llvm.StructType(fields, false)
+}
+
+// vim: set ft=go :
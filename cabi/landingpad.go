@@ -0,0 +1,67 @@
+// Copyright 2011 The llgo Authors.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package cabi
+
+import "github.com/axw/gollvm/llvm"
+
+// checkLandingPads verifies that fn's landingpad instructions
+// (emitted by irgen's makeDeferBlock) stay within the subset every
+// target here accepts: the `{i8*, i32}` exception/selector pair a
+// landingpad produces is a register value, not a memory object, and
+// PNaCl's stable ABI only special-cases it on the condition that
+// it's consumed immediately by extractvalue and never otherwise
+// stored, passed to a phi, or spilled to memory.
+//
+// This is deliberately a validation pass, not the per-platform
+// expansion the landingpad result might eventually need: every
+// target cabi currently lowers for (x86, arm, pnacl) accepts the
+// same extractvalue-only pattern, and irgen's own codegen already
+// produces exactly that pattern (see makeDeferBlock), so there is
+// nothing to rewrite yet. If a future target needs the pair
+// represented differently (say, two separate scalar landingpads, or
+// an EH model that doesn't have a landingpad instruction at all),
+// that rewrite belongs here, gated on l's target the same way
+// restrict.go is gated on l.pnacl; until then this exists so a
+// codegen change that breaks the assumption is caught here, as a
+// clear cabi error, rather than surfacing as an opaque abicheck
+// failure in the backend.
+func (l *Lowering) checkLandingPads(fn llvm.Value) error {
+	for b := fn.FirstBasicBlock(); b.C != nil; b = llvm.NextBasicBlock(b) {
+		for instr := b.FirstInstruction(); instr.C != nil; instr = llvm.NextInstruction(instr) {
+			if instr.InstructionOpcode() != llvm.LandingPad {
+				continue
+			}
+			if err := checkLandingPadUses(instr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// checkLandingPadUses returns an error if lp, a landingpad
+// instruction's aggregate result, is used by anything other than an
+// extractvalue.
+func checkLandingPadUses(lp llvm.Value) error {
+	for use := lp.FirstUse(); use.C != nil; use = use.NextUse() {
+		user := use.User()
+		if user.InstructionOpcode() != llvm.ExtractValue {
+			return &landingPadError{fn: lp.InstructionParent().Parent().Name()}
+		}
+	}
+	return nil
+}
+
+// landingPadError reports that a function's landingpad result
+// escaped the extractvalue-only pattern cabi requires.
+type landingPadError struct {
+	fn string
+}
+
+func (e *landingPadError) Error() string {
+	return "cabi: landingpad result used indirectly in " + e.fn
+}
+
+// vim: set ft=go :
@@ -0,0 +1,116 @@
+// Copyright 2011 The llgo Authors.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package cabi
+
+import "github.com/axw/gollvm/llvm"
+
+// restrict rewrites module's functions to stay within PNaCl's stable
+// IR subset: no i1 value may live in memory (only in a register),
+// and no aggregate may contain a vector. byval is never used for
+// classMemory parameters in the first place (lowerSignature passes
+// them as plain pointers, loaded explicitly in the wrapper), which
+// sidesteps byval's more restrictive, per-target legality rules
+// entirely rather than needing to special-case them here.
+func (l *Lowering) restrict(module llvm.Module) error {
+	for fn := module.FirstFunction(); fn.C != nil; fn = llvm.NextFunction(fn) {
+		if fn.IsDeclaration() {
+			continue
+		}
+		restrictBoolMemory(fn)
+		if err := restrictVectorAggregates(fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// restrictBoolMemory widens every i1 alloca in fn to an i8 alloca,
+// rewriting its loads and stores to truncate/zero-extend at the
+// boundary, since PNaCl's stable ABI doesn't allow i1 to appear as
+// anything but a register value (e.g. a comparison result).
+func restrictBoolMemory(fn llvm.Value) {
+	for b := fn.FirstBasicBlock(); b.C != nil; b = llvm.NextBasicBlock(b) {
+		for instr := b.FirstInstruction(); instr.C != nil; {
+			next := llvm.NextInstruction(instr)
+			if instr.InstructionOpcode() == llvm.Alloca && instr.Type().ElementType() == llvm.Int1Type() {
+				widenBoolAlloca(instr)
+			}
+			instr = next
+		}
+	}
+}
+
+// widenBoolAlloca replaces alloca, an `alloca i1`, with an `alloca
+// i8`, rewriting its users in place so the i1/i8 conversion happens
+// at each load and store rather than changing what type the rest of
+// the function sees.
+func widenBoolAlloca(alloca llvm.Value) {
+	builder := llvm.GlobalContext().NewBuilder()
+	defer builder.Dispose()
+
+	builder.SetInsertPointBefore(alloca)
+	wide := builder.CreateAlloca(llvm.Int8Type(), "")
+
+	for use := alloca.FirstUse(); use.C != nil; {
+		next := use.NextUse()
+		user := use.User()
+		builder.SetInsertPointBefore(user)
+		switch user.InstructionOpcode() {
+		case llvm.Load:
+			loaded := builder.CreateLoad(wide, "")
+			user.ReplaceAllUsesWith(builder.CreateTrunc(loaded, llvm.Int1Type(), ""))
+			user.EraseFromParentAsInstruction()
+		case llvm.Store:
+			extended := builder.CreateZExt(user.Operand(0), llvm.Int8Type(), "")
+			builder.CreateStore(extended, wide)
+			user.EraseFromParentAsInstruction()
+		}
+		use = next
+	}
+	alloca.EraseFromParentAsInstruction()
+}
+
+// restrictVectorAggregates returns an error if fn has any
+// instruction whose type is, or contains, a vector inside an
+// aggregate: PNaCl's stable ABI has no representation for these, and
+// irgen's Go-level codegen has no legitimate reason to produce one.
+func restrictVectorAggregates(fn llvm.Value) error {
+	for b := fn.FirstBasicBlock(); b.C != nil; b = llvm.NextBasicBlock(b) {
+		for instr := b.FirstInstruction(); instr.C != nil; instr = llvm.NextInstruction(instr) {
+			if t := instr.Type(); t.TypeKind() != llvm.VectorTypeKind && containsVector(t) {
+				return &vectorAggregateError{fn: fn.Name()}
+			}
+		}
+	}
+	return nil
+}
+
+func containsVector(t llvm.Type) bool {
+	switch t.TypeKind() {
+	case llvm.VectorTypeKind:
+		return true
+	case llvm.StructTypeKind:
+		for _, f := range t.StructElementTypes() {
+			if containsVector(f) {
+				return true
+			}
+		}
+	case llvm.ArrayTypeKind:
+		return containsVector(t.ElementType())
+	}
+	return false
+}
+
+// vectorAggregateError reports a vector aggregate found where
+// PNaCl's stable ABI disallows one.
+type vectorAggregateError struct {
+	fn string
+}
+
+func (e *vectorAggregateError) Error() string {
+	return "cabi: vector aggregate in " + e.fn + ", unsupported under pnacl's stable ABI"
+}
+
+// vim: set ft=go :
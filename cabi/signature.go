@@ -0,0 +1,168 @@
+// Copyright 2011 The llgo Authors.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package cabi
+
+import "github.com/axw/gollvm/llvm"
+
+// abiFunc records how classifyFunc classified a single function:
+// whether its return is passed indirectly (sret), whether a direct
+// (non-sret) return still needs coercing to a packed-integer type,
+// and the class given to each of its original parameters.
+type abiFunc struct {
+	sret       bool
+	retCoerced bool      // retType is a classDirect aggregate needing coerce
+	retType    llvm.Type // original (pre-lowering) return type
+	params     []class
+}
+
+// needsLowering reports whether fn's signature differs from its
+// already-classified ABI form, i.e. whether lowerSignature has
+// anything to do.
+func (af *abiFunc) needsLowering() bool {
+	if af.sret || af.retCoerced {
+		return true
+	}
+	for _, c := range af.params {
+		if c == classMemory {
+			return true
+		}
+	}
+	return false
+}
+
+// classifyFunc classifies fnty's return type and parameters per a's
+// calling convention.
+func classifyFunc(a abi, target llvm.TargetData, fnty llvm.Type) *abiFunc {
+	af := &abiFunc{retType: fnty.ReturnType()}
+	if af.retType.TypeKind() != llvm.VoidTypeKind {
+		switch classify(a, target, af.retType) {
+		case classMemory:
+			af.sret = true
+		case classDirect:
+			// A classDirect return can still be an aggregate (a
+			// small struct/array within maxDirectSize): it's not
+			// passed through memory, but it still needs the same
+			// packed-integer coercion abiType gives a same-sized
+			// classDirect parameter, or the wrapper's return type
+			// won't match what a C caller expects in its return
+			// registers.
+			switch af.retType.TypeKind() {
+			case llvm.StructTypeKind, llvm.ArrayTypeKind:
+				af.retCoerced = true
+			}
+		}
+	}
+	for _, p := range fnty.ParamTypes() {
+		af.params = append(af.params, classify(a, target, p))
+	}
+	return af
+}
+
+// abiType returns the parameter or return type fn's ABI-conformant
+// signature uses in place of t, given t's classification under a: a
+// classMemory value becomes a pointer to t, and a classDirect
+// aggregate is coerced to its packed-integer equivalent (see
+// coerce); everything else (including classDirect scalars) is
+// unchanged.
+func abiType(a abi, target llvm.TargetData, t llvm.Type, c class) llvm.Type {
+	switch c {
+	case classMemory:
+		return llvm.PointerType(t, 0)
+	default:
+		switch t.TypeKind() {
+		case llvm.StructTypeKind, llvm.ArrayTypeKind:
+			return coerce(a, target.TypeAllocSize(t))
+		}
+		return t
+	}
+}
+
+// lowerSignature gives fn's externally-visible symbol a C-conformant
+// signature, if its natural one isn't already. The natural
+// definition is kept, under internal linkage and a mangled name, as
+// the target of a generated wrapper: existing call instructions
+// inside the module, which reference fn's llvm.Value and not its
+// name, go on calling the natural definition directly and are
+// untouched by this rewrite.
+func (l *Lowering) lowerSignature(fn llvm.Value) error {
+	fnty := fn.Type().ElementType()
+	af := classifyFunc(l.abi, l.target, fnty)
+	if !af.needsLowering() {
+		return nil
+	}
+
+	name := fn.Name()
+	linkage := fn.Linkage()
+	fn.SetName(name + ".llgo")
+	fn.SetLinkage(llvm.InternalLinkage)
+
+	paramtypes := fnty.ParamTypes()
+	var wrapperParams []llvm.Type
+	if af.sret {
+		wrapperParams = append(wrapperParams, llvm.PointerType(af.retType, 0))
+	}
+	for i, p := range paramtypes {
+		wrapperParams = append(wrapperParams, abiType(l.abi, l.target, p, af.params[i]))
+	}
+	wrapperRetType := af.retType
+	switch {
+	case af.sret:
+		wrapperRetType = llvm.VoidType()
+	case af.retCoerced:
+		wrapperRetType = coerce(l.abi, l.target.TypeAllocSize(af.retType))
+	}
+	wrapperFnType := llvm.FunctionType(wrapperRetType, wrapperParams, fnty.IsFunctionVarArg())
+	wrapper := llvm.AddFunction(fn.GlobalParent(), name, wrapperFnType)
+	wrapper.SetLinkage(linkage)
+	if af.sret {
+		wrapper.Param(0).AddAttribute(llvm.StructRetAttribute)
+	}
+
+	builder := llvm.GlobalContext().NewBuilder()
+	defer builder.Dispose()
+	entry := llvm.AddBasicBlock(wrapper, "")
+	builder.SetInsertPointAtEnd(entry)
+
+	wrapperParamOffset := 0
+	if af.sret {
+		wrapperParamOffset = 1
+	}
+	args := make([]llvm.Value, len(paramtypes))
+	for i, p := range paramtypes {
+		wparam := wrapper.Param(wrapperParamOffset + i)
+		switch af.params[i] {
+		case classMemory:
+			args[i] = builder.CreateLoad(wparam, "")
+		default:
+			switch p.TypeKind() {
+			case llvm.StructTypeKind, llvm.ArrayTypeKind:
+				slot := builder.CreateAlloca(wparam.Type(), "")
+				builder.CreateStore(wparam, slot)
+				args[i] = builder.CreateLoad(builder.CreateBitCast(slot, llvm.PointerType(p, 0), ""), "")
+			default:
+				args[i] = wparam
+			}
+		}
+	}
+
+	result := builder.CreateCall(fn, args, "")
+	switch {
+	case af.sret:
+		builder.CreateStore(result, wrapper.Param(0))
+		builder.CreateRetVoid()
+	case af.retType.TypeKind() == llvm.VoidTypeKind:
+		builder.CreateRetVoid()
+	case af.retCoerced:
+		slot := builder.CreateAlloca(result.Type(), "")
+		builder.CreateStore(result, slot)
+		coerced := builder.CreateLoad(builder.CreateBitCast(slot, llvm.PointerType(wrapperRetType, 0), ""), "")
+		builder.CreateRet(coerced)
+	default:
+		builder.CreateRet(result)
+	}
+	return nil
+}
+
+// vim: set ft=go :
@@ -0,0 +1,65 @@
+// Copyright 2011 The llgo Authors.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package debug holds the descriptor helpers irgen uses to build
+// DWARF debug info, kept separate so the core IR generator doesn't
+// need to know the shape of a compile unit descriptor.
+package debug
+
+import "github.com/axw/gollvm/llvm"
+
+const (
+	// Producer identifies llgo as the producer of a compile unit, for
+	// the benefit of debuggers inspecting the Producer field.
+	Producer = "llgo"
+
+	// RuntimeVersion is the Go runtime version reported in a compile
+	// unit descriptor's Runtime field.
+	RuntimeVersion = 0
+)
+
+// Info holds the debug-information state for a single module: the
+// stack of in-progress descriptors, and the underlying LLVM
+// debug-info builder used to turn them into metadata nodes.
+type Info struct {
+	llvm.DebugInfo
+	context []llvm.DebugDescriptor
+}
+
+// NewInfo creates debug-information state for a new module.
+func NewInfo() *Info {
+	return &Info{}
+}
+
+// Push records d as the innermost open debug descriptor.
+func (i *Info) Push(d llvm.DebugDescriptor) {
+	i.context = append(i.context, d)
+}
+
+// Pop removes and returns the innermost open debug descriptor. It
+// panics if there is no open descriptor.
+func (i *Info) Pop() llvm.DebugDescriptor {
+	n := len(i.context)
+	d := i.context[n-1]
+	i.context = i.context[:n-1]
+	return d
+}
+
+// Open reports whether there are any descriptors still open.
+func (i *Info) Open() bool {
+	return len(i.context) > 0
+}
+
+// CompileUnit returns a descriptor for a single compiled source
+// file, attributing it to this version of llgo.
+func CompileUnit(path string) *llvm.CompileUnitDescriptor {
+	return &llvm.CompileUnitDescriptor{
+		Language: llvm.DW_LANG_Go,
+		Path:     llvm.FileDescriptor(path),
+		Producer: Producer,
+		Runtime:  RuntimeVersion,
+	}
+}
+
+// vim: set ft=go :
@@ -0,0 +1,114 @@
+// Copyright 2011 The llgo Authors.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package driver holds the compiler-independent pieces of llgo's
+// command line driver: target triple parsing, PNaCl handling, and
+// the options a compilation is configured with. It has no
+// dependency on irgen, so that other tools can resolve a target the
+// same way llgo does without linking in the full compiler.
+package driver
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/axw/gollvm/llvm"
+)
+
+// CompilerOptions are the user-supplied options that configure a
+// compilation, independent of any particular package's source.
+type CompilerOptions struct {
+	// TargetTriple is the LLVM triple for the target.
+	TargetTriple string
+
+	// GenerateDebug decides whether debug data is
+	// generated in the output module.
+	GenerateDebug bool
+
+	// Logger is a logger used for tracing compilation.
+	Logger *log.Logger
+}
+
+// ParseArch normalizes a triple's architecture field to the name LLVM
+// uses for the corresponding target, e.g. "amd64" and "x86_64" both
+// become "x86-64". It is exported so other packages that need to
+// reason about a triple's architecture without depending on the rest
+// of this package's target-machine resolution, such as cabi choosing
+// an ABI to lower for, can reuse the same parsing ResolveTarget uses
+// rather than duplicating LLVM's triple-parsing rules.
+//
+// Based on parseArch from LLVM's lib/Support/Triple.cpp.
+func ParseArch(arch string) string {
+	switch arch {
+	case "i386", "i486", "i586", "i686", "i786", "i886", "i986":
+		return "x86"
+	case "amd64", "x86_64":
+		return "x86-64"
+	case "powerpc":
+		return "ppc"
+	case "powerpc64", "ppu":
+		return "ppc64"
+	case "mblaze":
+		return "mblaze"
+	case "arm", "xscale":
+		return "arm"
+	case "thumb":
+		return "thumb"
+	case "spu", "cellspu":
+		return "cellspu"
+	case "msp430":
+		return "msp430"
+	case "mips", "mipseb", "mipsallegrex":
+		return "mips"
+	case "mipsel", "mipsallegrexel":
+		return "mipsel"
+	case "mips64", "mips64eb":
+		return "mips64"
+	case "mipsel64":
+		return "mipsel64"
+	case "r600", "hexagon", "sparc", "sparcv9", "tce",
+		"xcore", "nvptx", "nvptx64", "le32", "amdil":
+		return arch
+	}
+	if strings.HasPrefix(arch, "armv") {
+		return "arm"
+	} else if strings.HasPrefix(arch, "thumbv") {
+		return "thumb"
+	}
+	return "unknown"
+}
+
+// ResolveTarget normalizes opts.TargetTriple (expanding the "pnacl"
+// pseudo-triple to PNaClTriple) and selects the LLVM target machine
+// matching its architecture. The returned pnacl flag records whether
+// the triple was originally "pnacl", since opts.TargetTriple will
+// have been rewritten in place to the true triple used to compile
+// PNaCl modules.
+func ResolveTarget(opts *CompilerOptions) (machine llvm.TargetMachine, pnacl bool, err error) {
+	if strings.ToLower(opts.TargetTriple) == "pnacl" {
+		opts.TargetTriple = PNaClTriple
+		pnacl = true
+	}
+
+	// Triples are several fields separated by '-' characters.
+	// The first field is the architecture. The architecture's
+	// canonical form may include a '-' character, which would
+	// have been translated to '_' for inclusion in a triple.
+	triple := opts.TargetTriple
+	arch := triple[:strings.IndexRune(triple, '-')]
+	arch = ParseArch(arch)
+	for target := llvm.FirstTarget(); target.C != nil; target = target.NextTarget() {
+		if arch == target.Name() {
+			machine = target.CreateTargetMachine(triple, "", "",
+				llvm.CodeGenLevelDefault,
+				llvm.RelocDefault,
+				llvm.CodeModelDefault)
+			return machine, pnacl, nil
+		}
+	}
+	return llvm.TargetMachine{}, pnacl, fmt.Errorf("Invalid target triple: %s", triple)
+}
+
+// vim: set ft=go :
@@ -0,0 +1,324 @@
+// Copyright 2011 The llgo Authors.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+// Package irgen translates type-checked Go packages into LLVM IR. It
+// owns the compiler state and the statement/expression visitors;
+// target resolution lives in driver, and DWARF descriptor helpers
+// live in debug. irgen imports driver for CompilerOptions and
+// ResolveTarget; driver does not import irgen.
+package irgen
+
+import (
+	"fmt"
+	"go/token"
+
+	"github.com/axw/gollvm/llvm"
+	llgobuild "github.com/axw/llgo/build"
+	"github.com/axw/llgo/cabi"
+	"github.com/axw/llgo/debug"
+	"github.com/axw/llgo/driver"
+	"golang.org/x/tools/go/loader"
+	"golang.org/x/tools/go/ssa"
+	"golang.org/x/tools/go/ssa/ssautil"
+	"golang.org/x/tools/go/types"
+)
+
+// runtimeImportPath is the import path of the runtime package whose
+// functions (runtime.pushdefer, runtime.rundefers, ...) irgen calls
+// directly. It's loaded from source alongside the user's package, so
+// those functions can be resolved by *ssa.Function rather than by
+// parsing a hand-written Go type string at every call site.
+const runtimeImportPath = "runtime"
+
+type Module struct {
+	llvm.Module
+	Name     string
+	Disposed bool
+}
+
+func (m Module) Dispose() {
+	if !m.Disposed {
+		m.Disposed = true
+		m.Module.Dispose()
+	}
+}
+
+type Compiler interface {
+	Compile(filenames []string, importpath string) (*Module, error)
+	Dispose()
+}
+
+type compiler struct {
+	driver.CompilerOptions
+
+	builder *Builder
+	module  *Module
+	machine llvm.TargetMachine
+	target  llvm.TargetData
+	pkg     *types.Package
+	fileset *token.FileSet
+
+	exportedtypes []types.Type
+
+	*FunctionCache
+	llvmtypes *LLVMTypeMap
+	types     *TypeMap
+
+	// runtimepkg is the SSA form of runtimeImportPath, loaded
+	// explicitly alongside the user's package so that runtime
+	// functions can be looked up by *ssa.Function (see runtimeFunc)
+	// rather than declared ad hoc from a Go type string.
+	runtimepkg *ssa.Package
+
+	// pnacl is set to true if the target triple was originally
+	// specified as "pnacl". See driver.ResolveTarget.
+	pnacl bool
+
+	debug *debug.Info
+}
+
+///////////////////////////////////////////////////////////////////////////////
+
+// NewCompiler creates a new Compiler for translating Go packages
+// into LLVM modules, targeting the architecture described by
+// opts.TargetTriple.
+func NewCompiler(opts driver.CompilerOptions) (Compiler, error) {
+	c := &compiler{CompilerOptions: opts}
+	machine, pnacl, err := driver.ResolveTarget(&c.CompilerOptions)
+	if err != nil {
+		return nil, err
+	}
+	c.machine = machine
+	c.pnacl = pnacl
+	c.target = machine.TargetData()
+	return c, nil
+}
+
+func (c *compiler) Dispose() {
+	if c.machine.C != nil {
+		c.machine.Dispose()
+		c.machine.C = nil
+	}
+}
+
+func (c *compiler) logf(format string, v ...interface{}) {
+	if c.Logger != nil {
+		c.Logger.Printf(format, v...)
+	}
+}
+
+// runtimeFunc returns the LLVM function value for the named function
+// in runtimeImportPath, resolved via its *ssa.Function rather than
+// declared from a hand-written Go type string.
+func (c *compiler) runtimeFunc(name string) llvm.Value {
+	fn := c.runtimepkg.Func(name)
+	if fn == nil {
+		panic("undefined runtime function: " + name)
+	}
+	return c.resolveFunction(fn).LLVMValue()
+}
+
+func (c *compiler) Compile(filenames []string, importpath string) (m *Module, err error) {
+	// FIXME create a compilation state, rather than storing in 'compiler'.
+	c.exportedtypes = nil
+	c.llvmtypes = NewLLVMTypeMap(c.target)
+
+	buildctx, err := llgobuild.Context(c.TargetTriple)
+	if err != nil {
+		return nil, err
+	}
+
+	var conf loader.Config
+	conf.Build = buildctx
+	conf.SourceImports = true
+	conf.TypeChecker.Import = (&importer{compiler: c}).Import
+	conf.TypeChecker.Sizes = c.llvmtypes
+
+	astFiles, err := parseFiles(conf.Fset, filenames)
+	if err != nil {
+		return nil, err
+	}
+	// If no import path is specified, or the package's
+	// name (not path) is "main", then set the import
+	// path to be the same as the package's name.
+	if pkgname := astFiles[0].Name.String(); importpath == "" || pkgname == "main" {
+		importpath = pkgname
+	}
+	conf.CreateFromFiles(importpath, astFiles...)
+	conf.Import(runtimeImportPath)
+
+	iprog, err := conf.Load()
+	if err != nil {
+		return nil, err
+	}
+	c.fileset = iprog.Fset
+
+	prog := ssautil.CreateProgram(iprog, ssa.SanityCheckFunctions)
+	mainpkg := prog.Package(iprog.Created[0].Pkg)
+	mainpkg.Build()
+
+	c.runtimepkg = prog.Package(iprog.Imported[runtimeImportPath].Pkg)
+	c.runtimepkg.Build()
+
+	// Create a Module, which contains the LLVM bitcode. Dispose it on panic,
+	// otherwise we'll set a finalizer at the end. The caller may invoke
+	// Dispose manually, which will render the finalizer a no-op.
+	modulename := importpath
+	c.module = &Module{llvm.NewModule(modulename), modulename, false}
+	c.module.SetTarget(c.TargetTriple)
+	c.module.SetDataLayout(c.target.String())
+	defer func() {
+		if e := recover(); e != nil {
+			c.module.Dispose()
+			panic(e)
+		}
+	}()
+
+	// Create a struct responsible for mapping static types to LLVM types,
+	// and to runtime/dynamic type values.
+	c.FunctionCache = NewFunctionCache(c)
+	c.types = NewTypeMap(
+		c.llvmtypes,
+		c.module.Module,
+		importpath,
+		c.FunctionCache,
+	)
+
+	// Create a Builder, for building LLVM instructions.
+	c.builder = newBuilder(c.types)
+	defer c.builder.Dispose()
+
+	// c.debug is always non-nil, so that code paths which refer to it
+	// unconditionally (createMainFunction's debug location, say) don't
+	// need their own nil check; it simply stays empty when
+	// GenerateDebug is false.
+	c.debug = debug.NewInfo()
+
+	c.translatePackage(mainpkg)
+
+	// Lower every function's externally-visible signature to the
+	// target's C ABI, and (for a PNaCl target) restrict the module to
+	// pnacl-abicheck's stable IR subset. This runs after
+	// translatePackage so it sees every function translatePackage
+	// produced, and before the module is returned so x86, arm, and
+	// pnacl builds all go through the same path.
+	if err := cabi.New(c.target, c.TargetTriple, c.pnacl).Lower(c.module.Module); err != nil {
+		return nil, err
+	}
+
+	if c.GenerateDebug {
+		for _, file := range astFiles {
+			cu := debug.CompileUnit(c.fileset.File(file.Pos()).Name())
+			c.module.AddNamedMetadataOperand("llvm.dbg.cu", c.debug.MDNode(cu))
+		}
+	}
+
+	// Wrap "main.main" in a call to runtime.main.
+	if importpath == "main" {
+		if err = c.createMainFunction(); err != nil {
+			return nil, err
+		}
+	} else {
+		var e = exporter{compiler: c}
+		if err := e.Export(mainpkg.Pkg); err != nil {
+			return nil, err
+		}
+	}
+
+	/*
+		// Create global constructors. The initfuncs/varinitfuncs
+		// slices are in the order of visitation; we generate the
+		// list of constructors in the reverse order.
+		//
+		// The llgo linker will link modules in the order of
+		// package dependency, i.e. if A requires B, then llgo-link
+		// will link the modules in the order A, B. The "runtime"
+		// package is always last.
+		//
+		// At program initialisation, the runtime initialisation
+		// function (runtime.main) will invoke the constructors
+		// in reverse order.
+		var initfuncs [][]llvm.Value
+		if c.varinitfuncs != nil {
+			initfuncs = append(initfuncs, c.varinitfuncs)
+		}
+		if c.initfuncs != nil {
+			initfuncs = append(initfuncs, c.initfuncs)
+		}
+		if initfuncs != nil {
+			ctortype := llvm.PointerType(llvm.Int8Type(), 0)
+			var ctors []llvm.Value
+			var index int = 0
+			for _, initfuncs := range initfuncs {
+				for _, fnptr := range initfuncs {
+					name := fmt.Sprintf("__llgo.ctor.%s.%d", importpath, index)
+					fnptr.SetName(name)
+					fnptr = llvm.ConstBitCast(fnptr, ctortype)
+					ctors = append(ctors, fnptr)
+					index++
+				}
+			}
+			for i, n := 0, len(ctors); i < n/2; i++ {
+				ctors[i], ctors[n-i-1] = ctors[n-i-1], ctors[i]
+			}
+			ctorsInit := llvm.ConstArray(ctortype, ctors)
+			ctorsVar := llvm.AddGlobal(c.module.Module, ctorsInit.Type(), "runtime.ctors")
+			ctorsVar.SetInitializer(ctorsInit)
+			ctorsVar.SetLinkage(llvm.AppendingLinkage)
+		}
+	*/
+
+	return c.module, nil
+}
+
+func (c *compiler) createMainFunction() error {
+	// In a PNaCl program (plugin), there should not be a "main.main";
+	// instead, we expect a "main.CreateModule" function.
+	// See pkg/nacl/ppapi/ppapi.go for more details.
+	mainMain := c.module.NamedFunction("main.main")
+	/*
+		if c.pnacl {
+			// PNaCl's libppapi_stub.a implements "main", which simply
+			// calls through to PpapiPluginMain. We define our own "main"
+			// so that we can capture argc/argv.
+			if !mainMain.IsNil() {
+				return fmt.Errorf("Found main.main")
+			}
+			pluginMain := c.RuntimeFunction("PpapiPluginMain", "func() int32")
+
+			// Synthesise a main which has no return value. We could cast
+			// PpapiPluginMain, but this is potentially unsafe as its
+			// calling convention is unspecified.
+			ftyp := llvm.FunctionType(llvm.VoidType(), nil, false)
+			mainMain = llvm.AddFunction(c.module.Module, "main.main", ftyp)
+			entry := llvm.AddBasicBlock(mainMain, "entry")
+			c.builder.SetInsertPointAtEnd(entry)
+			c.builder.CreateCall(pluginMain, nil, "")
+			c.builder.CreateRetVoid()
+		} else */{
+		mainMain = c.module.NamedFunction("main.main")
+	}
+
+	if mainMain.IsNil() {
+		return fmt.Errorf("Could not find main.main")
+	}
+
+	// runtime.main is called by main, with argc, argv, argp,
+	// and a pointer to main.main, which must be a niladic
+	// function with no result. "main" itself is the C-ABI entry
+	// point, not a Go function, so it's still declared from a type
+	// string rather than resolved via runtimepkg.
+	runtimeMain := c.runtimeFunc("main")
+	main := c.RuntimeFunction("main", "func(int32, **byte, **byte) int32")
+	c.builder.SetCurrentDebugLocation(c.debug.MDNode(nil))
+	entry := llvm.AddBasicBlock(main, "entry")
+	c.builder.SetInsertPointAtEnd(entry)
+	mainMain = c.builder.CreateBitCast(mainMain, runtimeMain.Type().ElementType().ParamTypes()[3], "")
+	args := []llvm.Value{main.Param(0), main.Param(1), main.Param(2), mainMain}
+	result := c.builder.CreateCall(runtimeMain, args, "")
+	c.builder.CreateRet(result)
+	return nil
+}
+
+// vim: set ft=go :
@@ -0,0 +1,431 @@
+// Copyright 2013 The llgo Authors.
+// Use of this source code is governed by an MIT-style
+// license that can be found in the LICENSE file.
+
+package irgen
+
+import (
+	"github.com/axw/gollvm/llvm"
+	"golang.org/x/tools/go/ssa"
+	"golang.org/x/tools/go/types"
+)
+
+// hasCall reports whether fn contains any *ssa.Call instructions.
+// *ssa.Go and *ssa.Defer don't count: they start a call that doesn't
+// run synchronously in this frame, so they can't themselves cause us
+// to unwind.
+//
+// This is used to avoid creating an unwind block.
+func hasCall(fn *ssa.Function) bool {
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			if _, ok := instr.(*ssa.Call); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const (
+	// maxInlineDefers is the number of defer records kept inline in
+	// a function's deferPool. translateDefer does not count how many
+	// of them are in use; it sends a defer to the heap-allocated chain
+	// rooted at f.deferptr only when its arguments exceed
+	// maxInlineDeferArgs.
+	maxInlineDefers = 8
+
+	// maxInlineDeferArgs is the size, in bytes, of the argument
+	// buffer in each inline defer record. Deferred calls whose
+	// arguments don't fit spill to the heap path instead.
+	maxInlineDeferArgs = 24
+
+	// maxOpenCodedDefers is the number of *ssa.Defer instructions a
+	// function may contain and still be eligible for open-coding
+	// (see deferInstrs).
+	maxOpenCodedDefers = 8
+)
+
+// deferInstrs returns the *ssa.Defer instructions in fn, in the
+// order its SSA blocks were built, along with whether any of them
+// sit in a block that can reach itself. Such a block may run more
+// than once per call to fn (it's on a loop in the control-flow
+// graph), so a defer there can't be assigned a single static slot.
+func deferInstrs(fn *ssa.Function) (instrs []*ssa.Defer, inLoop bool) {
+	for _, b := range fn.Blocks {
+		for _, instr := range b.Instrs {
+			if d, ok := instr.(*ssa.Defer); ok {
+				instrs = append(instrs, d)
+				if blockReachesItself(b) {
+					inLoop = true
+				}
+			}
+		}
+	}
+	return instrs, inLoop
+}
+
+// blockReachesItself reports whether control can flow from one of
+// b's successors back to b, i.e. whether b sits on a cycle in its
+// function's control-flow graph. Walking the CFG like this (rather
+// than checking the source for *ast.ForStmt/*ast.RangeStmt, as an
+// AST-level version of this check would) catches every way a block
+// can run more than once per call, backward gotos included, not just
+// the two looping statements Go's grammar happens to name.
+func blockReachesItself(b *ssa.BasicBlock) bool {
+	seen := make(map[*ssa.BasicBlock]bool)
+	var reaches func(*ssa.BasicBlock) bool
+	reaches = func(n *ssa.BasicBlock) bool {
+		if n == b {
+			return true
+		}
+		if seen[n] {
+			return false
+		}
+		seen[n] = true
+		for _, s := range n.Succs {
+			if reaches(s) {
+				return true
+			}
+		}
+		return false
+	}
+	for _, s := range b.Succs {
+		if reaches(s) {
+			return true
+		}
+	}
+	return false
+}
+
+// closureType returns the LLVM representation of a Go closure value,
+// as produced by indirectFunction: a code pointer plus an opaque
+// pointer to its captured environment. Every open-coded defer slot
+// shares this one type regardless of the deferred call's actual
+// signature, so the unrolled epilogue can invoke any of them the
+// same way.
+func (c *compiler) closureType() llvm.Type {
+	i8ptr := llvm.PointerType(llvm.Int8Type(), 0)
+	return llvm.StructType([]llvm.Type{i8ptr, i8ptr}, false)
+}
+
+// deferRecordType returns the LLVM type of a single inline defer
+// record: the function to call, a byte buffer holding a copy of its
+// arguments, and a pointer chaining to the next record to run.
+func (c *compiler) deferRecordType() llvm.Type {
+	i8ptr := llvm.PointerType(llvm.Int8Type(), 0)
+	return llvm.StructType([]llvm.Type{
+		i8ptr, // fn
+		llvm.ArrayType(llvm.Int8Type(), maxInlineDeferArgs), // argsBlob
+		i8ptr, // next
+	}, false)
+}
+
+// deferPoolType returns the LLVM type of the inline defer pool
+// allocated in a function's entry block: a fixed-size array of
+// deferRecords, plus a count of how many of them are in use.
+func (c *compiler) deferPoolType() llvm.Type {
+	return llvm.StructType([]llvm.Type{
+		llvm.ArrayType(c.deferRecordType(), maxInlineDefers),
+		llvm.Int8Type(),
+	}, false)
+}
+
+// deferArgsBlobType returns the LLVM type of a struct holding a copy
+// of fntype's parameters, used to size and pack the argument buffer
+// passed to runtime.pushdeferInline.
+func (c *compiler) deferArgsBlobType(fntype *types.Signature) llvm.Type {
+	params := fntype.Params()
+	fieldtypes := make([]llvm.Type, params.Len())
+	for i := 0; i < params.Len(); i++ {
+		fieldtypes[i] = c.types.ToLLVM(params.At(i).Type())
+	}
+	return llvm.StructType(fieldtypes, false)
+}
+
+// goPersonality returns the "__go_personality_v0" function, declaring
+// it in the module if it hasn't already been declared.
+//
+// __go_personality_v0 is implemented in the runtime. It walks the
+// LSDA the same way __gxx_personality_v0 does, but its action table
+// entries distinguish the Go panic exception class from foreign
+// exceptions (C++, other language runtimes), so that a landingpad's
+// catch-all clause only ever receives something recover() is able to
+// make sense of.
+func (c *compiler) goPersonality() llvm.Value {
+	pers := c.module.Module.NamedFunction("__go_personality_v0")
+	if pers.IsNil() {
+		persftyp := llvm.FunctionType(llvm.Int32Type(), nil, true)
+		pers = llvm.AddFunction(c.module.Module, "__go_personality_v0", persftyp)
+	}
+	return pers
+}
+
+// makeDeferBlock creates a basic block for handling
+// defer statements, and code is emitted to allocate and
+// initialise a deferred function anchor point.
+//
+// This must be called before generating any code for fn's body (not
+// including allocating space for parameters and results).
+func (c *compiler) makeDeferBlock(f *function, fn *ssa.Function) {
+	currblock := c.builder.GetInsertBlock()
+	defer c.builder.SetInsertPointAtEnd(currblock)
+
+	// f.panicptr holds the exception pointer caught by this
+	// function's landingpad, if any. It is consumed (and cleared)
+	// by runtime.rundefers when a deferred call invokes recover().
+	i8ptr := llvm.PointerType(llvm.Int8Type(), 0)
+	landingPadType := llvm.StructType([]llvm.Type{i8ptr, llvm.Int32Type()}, false)
+	f.panicptr = c.createTypeMalloc(i8ptr)
+	c.builder.CreateStore(llvm.ConstNull(i8ptr), f.panicptr)
+
+	// If every defer in this function is a distinct *ssa.Defer
+	// instruction and none of them sit on a loop, we know the full
+	// set of deferred calls statically: open-code them into slots
+	// tested by a bitmap in the epilogue, and skip the runtime list
+	// entirely. Otherwise, fall back to the pool-backed scheme, which
+	// handles an unbounded or dynamic number of defers.
+	deferinstrs, deferInLoop := deferInstrs(fn)
+	f.openCodedDefers = len(deferinstrs) > 0 && len(deferinstrs) <= maxOpenCodedDefers && !deferInLoop
+	if f.openCodedDefers {
+		f.deferBitmap = c.builder.CreateAlloca(llvm.Int8Type(), "")
+		c.builder.CreateStore(llvm.ConstInt(llvm.Int8Type(), 0, false), f.deferBitmap)
+		f.deferIndex = make(map[*ssa.Defer]int, len(deferinstrs))
+		f.deferSlots = make([]llvm.Value, len(deferinstrs))
+		for i, instr := range deferinstrs {
+			f.deferIndex[instr] = i
+			f.deferSlots[i] = c.builder.CreateAlloca(c.closureType(), "")
+		}
+	} else {
+		// f.deferpool is a small, fixed-size array of defer records
+		// allocated inline in this frame. The common case of a
+		// handful of defers is satisfied entirely out of this pool,
+		// with no malloc; translateDefer uses the heap-allocated
+		// chain only for a call whose arguments don't fit a record's
+		// buffer, and does not itself check whether the pool is full.
+		f.deferptr = c.createTypeMalloc(c.target.IntPtrType())
+		f.deferpool = c.builder.CreateAlloca(c.deferPoolType(), "")
+		count := c.builder.CreateStructGEP(f.deferpool, 1, "")
+		c.builder.CreateStore(llvm.ConstInt(llvm.Int8Type(), 0, false), count)
+	}
+
+	f.deferblock = llvm.AddBasicBlock(currblock.Parent(), "")
+	if len(deferinstrs) > 0 || hasCall(fn) {
+		f.unwindblock = llvm.AddBasicBlock(currblock.Parent(), "")
+		f.unwindblock.MoveAfter(currblock)
+		f.deferblock.MoveAfter(f.unwindblock)
+
+		// f.unwindval holds the full {exception, selector} pair our
+		// landingpad produces, so that a panic the defer chain below
+		// doesn't recover can be resumed with the exact aggregate
+		// libunwind handed us, not just the f.panicptr exception
+		// pointer recover() consumes.
+		f.unwindval = c.builder.CreateAlloca(landingPadType, "")
+	} else {
+		f.deferblock.MoveAfter(currblock)
+	}
+
+	// Create a landingpad/unwind target basic block. The landingpad
+	// has a catch-all clause, so that both Go panics and foreign
+	// exceptions unwinding through this frame land here, and a
+	// cleanup clause, so that the frame's defers still run when the
+	// exception is merely passing through on its way further up the
+	// stack (libunwind's Itanium ABI, not setjmp/longjmp).
+	if !f.unwindblock.IsNil() {
+		c.builder.SetInsertPointAtEnd(f.unwindblock)
+		lp := c.builder.CreateLandingPad(landingPadType, c.goPersonality(), 1, "")
+		lp.AddClause(llvm.ConstNull(i8ptr))
+		lp.SetCleanup(true)
+		exc := c.builder.CreateExtractValue(lp, 0, "")
+		sel := c.builder.CreateExtractValue(lp, 1, "")
+		c.builder.CreateStore(exc, c.builder.CreateStructGEP(f.unwindval, 0, ""))
+		c.builder.CreateStore(sel, c.builder.CreateStructGEP(f.unwindval, 1, ""))
+		c.builder.CreateStore(exc, f.panicptr)
+		c.builder.CreateBr(f.deferblock)
+	}
+
+	// Create a real return instruction.
+	c.builder.SetInsertPointAtEnd(f.deferblock)
+	panicval := c.builder.CreateLoad(f.panicptr, "")
+
+	checkblock := llvm.AddBasicBlock(currblock.Parent(), "")
+	checkblock.MoveAfter(f.deferblock)
+	retblock := llvm.AddBasicBlock(currblock.Parent(), "")
+	retblock.MoveAfter(checkblock)
+
+	if f.openCodedDefers {
+		c.emitOpenCodedDefers(f, panicval, checkblock)
+	} else {
+		// Drain the inline pool first (in LIFO order), then the
+		// heap-allocated overflow chain.
+		rundefersInline := c.runtimeFunc("rundefersInline")
+		c.builder.CreateCall(rundefersInline, []llvm.Value{f.deferpool, panicval}, "")
+
+		deferhead := c.builder.CreateLoad(f.deferptr, "")
+		rundefers := c.runtimeFunc("rundefers")
+		c.builder.CreateCall(rundefers, []llvm.Value{deferhead, panicval}, "")
+		c.builder.CreateBr(checkblock)
+	}
+
+	// checkblock runs once every defer in this frame has had its
+	// chance to recover(): reload f.panicptr (rundefers/rundefersInline
+	// clear it in place when a deferred call consumes the panic) and,
+	// if it's still set, resume unwinding with the original landingpad
+	// result instead of falling through to a normal return. A function
+	// with no unwind block can never have a non-nil panicptr here (it
+	// has no landingpad to populate one from), so it skips straight to
+	// retblock.
+	c.builder.SetInsertPointAtEnd(checkblock)
+	if f.unwindblock.IsNil() {
+		c.builder.CreateBr(retblock)
+	} else {
+		remaining := c.builder.CreateLoad(f.panicptr, "")
+		recovered := c.builder.CreateICmp(llvm.IntEQ, remaining, llvm.ConstNull(i8ptr), "")
+		resumeblock := llvm.AddBasicBlock(currblock.Parent(), "")
+		resumeblock.MoveAfter(checkblock)
+		c.builder.CreateCondBr(recovered, retblock, resumeblock)
+
+		c.builder.SetInsertPointAtEnd(resumeblock)
+		unwindval := c.builder.CreateLoad(f.unwindval, "")
+		c.builder.CreateResume(unwindval)
+	}
+
+	c.builder.SetInsertPointAtEnd(retblock)
+	if len(f.results) == 0 {
+		c.builder.CreateRetVoid()
+	} else {
+		values := make([]llvm.Value, len(f.results))
+		for i, v := range f.results {
+			values[i] = c.objectdata[v].Value.LLVMValue()
+		}
+		if len(values) == 1 {
+			c.builder.CreateRet(values[0])
+		} else {
+			c.builder.CreateAggregateRet(values)
+		}
+	}
+}
+
+// emitOpenCodedDefers unrolls f's deferred calls into the basic
+// block the builder is currently positioned at (f.deferblock),
+// testing each slot's bitmap bit and invoking it directly in
+// reverse (LIFO) order, then branching to doneblock once every slot
+// has been tested. This replaces the call to runtime.rundefers for
+// functions whose defers were all statically enumerable; doneblock is
+// where the caller checks whether any of these calls recovered the
+// in-flight panic.
+//
+// panicval is passed to every slot's call the same way rundefers and
+// rundefersInline pass it to the closures they invoke, so that a
+// recover() inside an open-coded deferred call can observe and clear
+// this frame's in-flight panic exactly as it would in the pool-backed
+// path.
+func (c *compiler) emitOpenCodedDefers(f *function, panicval llvm.Value, doneblock llvm.BasicBlock) {
+	i8ptr := llvm.PointerType(llvm.Int8Type(), 0)
+	fntype := llvm.FunctionType(llvm.VoidType(), []llvm.Type{i8ptr, i8ptr}, false)
+	fnptrtype := llvm.PointerType(fntype, 0)
+
+	entry := c.builder.GetInsertBlock()
+	next := doneblock
+	for i := 0; i < len(f.deferSlots); i++ {
+		callblock := llvm.AddBasicBlock(doneblock.Parent(), "")
+		testblock := llvm.AddBasicBlock(doneblock.Parent(), "")
+		callblock.MoveBefore(next)
+		testblock.MoveBefore(callblock)
+
+		c.builder.SetInsertPointAtEnd(callblock)
+		slot := f.deferSlots[i]
+		code := c.builder.CreateLoad(c.builder.CreateStructGEP(slot, 0, ""), "")
+		env := c.builder.CreateLoad(c.builder.CreateStructGEP(slot, 1, ""), "")
+		code = c.builder.CreateBitCast(code, fnptrtype, "")
+		c.emitCall(f, code, []llvm.Value{env, panicval}, "")
+		c.builder.CreateBr(next)
+
+		c.builder.SetInsertPointAtEnd(testblock)
+		bitmap := c.builder.CreateLoad(f.deferBitmap, "")
+		mask := llvm.ConstInt(llvm.Int8Type(), uint64(1)<<uint(i), false)
+		bit := c.builder.CreateAnd(bitmap, mask, "")
+		unset := c.builder.CreateICmp(llvm.IntEQ, bit, llvm.ConstInt(llvm.Int8Type(), 0, false), "")
+		c.builder.CreateCondBr(unset, next, callblock)
+
+		next = testblock
+	}
+	c.builder.SetInsertPointAtEnd(entry)
+	c.builder.CreateBr(next)
+}
+
+// translateDefer lowers a single *ssa.Defer instruction. Unlike the
+// ast.DeferStmt this replaces, instr.Call is already a fully-lowered
+// ssa.CallCommon: its Value and Args are SSA values we've already
+// translated, so there's no type-checking left to do here.
+func (c *compiler) translateDefer(f *function, instr *ssa.Defer) {
+	fn := c.value(instr.Call.Value).(*LLVMValue)
+	args := make([]*LLVMValue, len(instr.Call.Args))
+	for i, arg := range instr.Call.Args {
+		args[i] = c.value(arg).(*LLVMValue)
+	}
+
+	if f.openCodedDefers {
+		// This defer's slot and bitmap bit are both known statically
+		// (assigned in makeDeferBlock); record the call there
+		// instead of pushing onto a runtime list.
+		idx := f.deferIndex[instr]
+		funcval := c.indirectFunction(fn, args, false)
+		c.builder.CreateStore(funcval.LLVMValue(), f.deferSlots[idx])
+
+		bitmap := c.builder.CreateLoad(f.deferBitmap, "")
+		mask := llvm.ConstInt(llvm.Int8Type(), uint64(1)<<uint(idx), false)
+		bitmap = c.builder.CreateOr(bitmap, mask, "")
+		c.builder.CreateStore(bitmap, f.deferBitmap)
+		return
+	}
+
+	i8ptr := llvm.PointerType(llvm.Int8Type(), 0)
+
+	argsBlobType := c.deferArgsBlobType(instr.Call.Signature())
+	argsize := c.target.TypeAllocSize(argsBlobType)
+	if argsize <= maxInlineDeferArgs {
+		// Copy args into a buffer laid out as a struct of the call's
+		// parameters, and hand it to the pool along with fn. This avoids
+		// both the per-defer malloc and the closure allocation that
+		// indirectFunction would otherwise need, in the common case
+		// of a handful of statically-known defers.
+		argsbuf := c.builder.CreateAlloca(argsBlobType, "")
+		for i, arg := range args {
+			field := c.builder.CreateStructGEP(argsbuf, i, "")
+			c.builder.CreateStore(arg.LLVMValue(), field)
+		}
+		fnptr := c.builder.CreateBitCast(fn.LLVMValue(), i8ptr, "")
+		argsptr := c.builder.CreateBitCast(argsbuf, i8ptr, "")
+		sizeval := llvm.ConstInt(c.target.IntPtrType(), argsize, false)
+		pushdeferInline := c.runtimeFunc("pushdeferInline")
+		c.emitCall(f, pushdeferInline, []llvm.Value{f.deferpool, fnptr, sizeval, argsptr}, "")
+		return
+	}
+
+	// Argument list doesn't fit an inline record; fall back to the
+	// heap-allocated chain, via a closure capturing fn+args.
+	pushdefer := c.runtimeFunc("pushdefer")
+	funcval := c.indirectFunction(fn, args, false)
+	c.emitCall(f, pushdefer, []llvm.Value{funcval.LLVMValue(), f.deferptr}, "")
+}
+
+// emitCall emits either a "call" or an "invoke" instruction for a
+// function call, depending on whether the enclosing function has an
+// unwind block to route exceptions through. Functions that neither
+// defer nor (transitively, via hasCall) make calls that could
+// themselves unwind have no unwind block, and so fall back to a
+// plain "call". translateDefer and emitOpenCodedDefers both call
+// through here rather than calling c.builder.CreateCall directly, so
+// a panic raised by a deferred call, or by pushing one onto the
+// defer list, still reaches this frame's own landingpad.
+func (c *compiler) emitCall(f *function, fn llvm.Value, args []llvm.Value, name string) llvm.Value {
+	if f.unwindblock.IsNil() {
+		return c.builder.CreateCall(fn, args, name)
+	}
+	contblock := llvm.AddBasicBlock(c.builder.GetInsertBlock().Parent(), "")
+	contblock.MoveAfter(c.builder.GetInsertBlock())
+	result := c.builder.CreateInvoke(fn, args, contblock, f.unwindblock, name)
+	c.builder.SetInsertPointAtEnd(contblock)
+	return result
+}